@@ -1,25 +1,182 @@
 package headscale
 
 import (
+	"bufio"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"expvar"
 	"fmt"
+	"io"
+	"math/big"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
 	"tailscale.com/derp"
+	"tailscale.com/derp/derphttp"
 	"tailscale.com/net/stun"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
 )
 
+var (
+	stunRequests  = expvar.NewInt("headscale_stun_requests")
+	stunMalformed = expvar.NewInt("headscale_stun_malformed_packets")
+	stunLimited   = expvar.NewInt("headscale_stun_rate_limited")
+
+	derpUpgrades     = expvar.NewInt("headscale_derp_upgrade_requests")
+	derpSessions     = expvar.NewInt("headscale_derp_active_sessions")
+	derpBytesRelayed = expvar.NewInt("headscale_derp_bytes_relayed")
+
+	// derpBytesRelayedTotal is the running total behind
+	// currentDERPBytesRelayed/promDERPBytesRelayed. It is incremented
+	// directly by countingReader/countingWriter at the point headscale
+	// hijacks a client's connection and hands it to the embedded
+	// tailscale.com/derp Server, rather than by polling that library's own
+	// internal expvar map (whose key names are an implementation detail,
+	// not a public API).
+	derpBytesRelayedTotal int64 // accessed via sync/atomic
+
+	meshPeersUp = expvar.NewMap("headscale_derp_mesh_peer_up")
+
+	bootstrapDNSOK   = expvar.NewInt("headscale_bootstrap_dns_refresh_ok")
+	bootstrapDNSFail = expvar.NewInt("headscale_bootstrap_dns_refresh_fail")
+
+	promSTUNRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "headscale_stun_requests_total",
+		Help: "Total number of STUN requests received by the embedded STUN server",
+	})
+	promSTUNMalformed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "headscale_stun_malformed_packets_total",
+		Help: "Total number of malformed packets received on the STUN listener",
+	})
+	promSTUNLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "headscale_stun_rate_limited_total",
+		Help: "Total number of STUN requests dropped by the per-source rate limiter",
+	})
+	promDERPUpgrades = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "headscale_derp_upgrade_requests_total",
+		Help: "Total number of DERP upgrade requests received",
+	})
+	promDERPSessions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "headscale_derp_active_sessions",
+		Help: "Number of currently active DERP sessions",
+	})
+	promDERPBytesRelayed = prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "headscale_derp_bytes_relayed_total",
+		Help: "Total number of bytes relayed through the embedded DERP server",
+	}, currentDERPBytesRelayed)
+	promDERPMeshPeerUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "headscale_derp_mesh_peer_up",
+		Help: "Whether the mesh connection to a peer DERP node is currently up (1) or down (0)",
+	}, []string{"peer"})
+	promBootstrapDNSOK = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "headscale_bootstrap_dns_refresh_ok_total",
+		Help: "Total number of successful bootstrap DNS refreshes",
+	})
+	promBootstrapDNSFail = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "headscale_bootstrap_dns_refresh_fail_total",
+		Help: "Total number of failed bootstrap DNS refreshes",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		promSTUNRequests,
+		promSTUNMalformed,
+		promSTUNLimited,
+		promDERPUpgrades,
+		promDERPSessions,
+		promDERPBytesRelayed,
+		promDERPMeshPeerUp,
+		promBootstrapDNSOK,
+		promBootstrapDNSFail,
+	)
+}
+
+// currentDERPBytesRelayed reports the cumulative bytes relayed through the
+// embedded DERP server, as tallied by countingReader/countingWriter, so it
+// can back a Prometheus CounterFunc without headscale keeping a second,
+// drifting tally.
+func currentDERPBytesRelayed() float64 {
+	return float64(atomic.LoadInt64(&derpBytesRelayedTotal))
+}
+
+// countingReader wraps an io.Reader and adds every byte read to
+// derpBytesRelayedTotal. DERPHandler wraps the *bufio.Reader returned by
+// Hijack() in one of these, so the bytes-relayed metric is tallied at a
+// point headscale itself controls instead of depending on the shape of
+// tailscale.com/derp's internals, while still draining through (rather than
+// discarding) any fast-start bytes net/http already buffered off the wire.
+type countingReader struct {
+	io.Reader
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		atomic.AddInt64(&derpBytesRelayedTotal, int64(n))
+	}
+	return n, err
+}
+
+// countingWriter is the write-side counterpart of countingReader.
+type countingWriter struct {
+	io.Writer
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if n > 0 {
+		atomic.AddInt64(&derpBytesRelayedTotal, int64(n))
+	}
+	return n, err
+}
+
+// watchDERPBytesRelayed periodically mirrors currentDERPBytesRelayed into
+// the plain expvar.Int alongside headscale's other DERP/STUN counters,
+// until ctx is done.
+func watchDERPBytesRelayed(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			derpBytesRelayed.Set(int64(currentDERPBytesRelayed()))
+		}
+	}
+}
+
+// RegisterDERPMetrics mounts the Prometheus /metrics endpoint used for the
+// embedded DERP and STUN server on the given router.
+func (h *Headscale) RegisterDERPMetrics(r *gin.Engine) {
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+}
+
 // fastStartHeader is the header (with value "1") that signals to the HTTP
 // server that the DERP HTTP client does not want the HTTP 101 response
 // headers and it will begin writing & reading the DERP protocol immediately
@@ -34,17 +191,130 @@ var (
 type DERPServer struct {
 	tailscaleDERP *derp.Server
 	region        tailcfg.DERPRegion
+	derpMap       atomic.Value // of *tailcfg.DERPMap
 }
 
+// embeddedDERPRegionID is the reserved RegionID headscale's own embedded
+// DERP always uses. Operator-supplied extra regions must not collide with
+// the 900-999 range reserved for embedded/first-party regions.
+const (
+	embeddedDERPRegionID = 999
+	reservedRegionIDMin  = 900
+	reservedRegionIDMax  = 999
+)
+
 func (h *Headscale) NewDERPServer() (*DERPServer, error) {
 	s := derp.NewServer(key.NodePrivate(*h.privateKey), log.Info().Msgf)
 	region, err := h.generateRegionLocalDERP()
 	if err != nil {
 		return nil, err
 	}
+
+	meshKey, err := h.readMeshKey()
+	if err != nil {
+		return nil, err
+	}
+	if meshKey != "" {
+		s.SetMeshKey(meshKey)
+	}
+
+	expvar.Publish("headscale_derp_server", s.ExpVar())
+
 	return &DERPServer{s, region}, nil
 }
 
+// readMeshKey loads the mesh pre-shared key from the path configured for
+// headscale's embedded DERP server. An empty path disables meshing and is
+// not an error.
+func (h *Headscale) readMeshKey() (string, error) {
+	if h.cfg.DERP.MeshPSKPath == "" {
+		return "", nil
+	}
+
+	content, err := os.ReadFile(h.cfg.DERP.MeshPSKPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read mesh psk file: %w", err)
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
+
+// watchMeshPeers dials and maintains a persistent, authenticated mesh
+// connection to every peer DERP node configured in h.cfg.DERP.MeshPeers,
+// reconnecting with backoff when a link drops. It dials nothing when no mesh
+// PSK path is configured. It is intended to be run as a background
+// goroutine next to ServeSTUN.
+func (h *Headscale) watchMeshPeers(ctx context.Context) {
+	if h.cfg.DERP.MeshPSKPath == "" {
+		return
+	}
+	for _, peerURL := range h.cfg.DERP.MeshPeers {
+		go h.watchMeshPeer(ctx, peerURL)
+	}
+}
+
+func (h *Headscale) watchMeshPeer(ctx context.Context, peerURL string) {
+	const (
+		minBackoff = time.Second
+		maxBackoff = time.Minute
+	)
+	backoff := minBackoff
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		client, err := derphttp.NewClient(key.NodePrivate(*h.privateKey), peerURL, log.Info().Msgf)
+		if err != nil {
+			log.Error().Caller().Err(err).Msgf("failed to create mesh client for %s", peerURL)
+		} else if meshKey, keyErr := h.readMeshKey(); keyErr != nil {
+			// NewDERPServer already proved the PSK file is readable once at
+			// startup, so a failure here is far more likely a transient read
+			// hiccup than a permanent misconfiguration. Treat it the same as
+			// a dropped connection and retry with backoff instead of giving
+			// up on this peer for good.
+			log.Error().Caller().Err(keyErr).Msgf("failed to read mesh key, will retry connecting to %s", peerURL)
+			client.Close()
+		} else {
+			client.SetMeshKey(meshKey)
+
+			log.Info().Msgf("connecting to mesh peer %s", peerURL)
+			up := new(expvar.Int)
+			up.Set(1)
+			meshPeersUp.Set(peerURL, up)
+			promDERPMeshPeerUp.WithLabelValues(peerURL).Set(1)
+			ownKey := h.privateKey.Public()
+			err = client.RunWatchConnectionLoop(ctx, ownKey, log.Info().Msgf,
+				func(pn key.NodePublic, _ bool, _ tailcfg.DERPNode) {
+					h.DERPServer.tailscaleDERP.AddPacketForwarder(pn, client)
+				},
+				func(pn key.NodePublic) {
+					h.DERPServer.tailscaleDERP.RemovePacketForwarder(pn, client)
+				},
+			)
+			client.Close()
+			meshPeersUp.Delete(peerURL)
+			promDERPMeshPeerUp.WithLabelValues(peerURL).Set(0)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Warn().Err(err).Msgf("mesh connection to %s dropped, reconnecting", peerURL)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
 func (h *Headscale) generateRegionLocalDERP() (tailcfg.DERPRegion, error) {
 	serverURL, err := url.Parse(h.cfg.ServerURL)
 	if err != nil {
@@ -68,23 +338,286 @@ func (h *Headscale) generateRegionLocalDERP() (tailcfg.DERPRegion, error) {
 		}
 	}
 
+	stunPort, stunOnly := h.stunPortAndMode()
+
 	localDERPregion := tailcfg.DERPRegion{
-		RegionID:   999,
+		RegionID:   embeddedDERPRegionID,
 		RegionCode: "headscale",
 		RegionName: "Headscale Embedded DERP",
 		Avoid:      false,
 		Nodes: []*tailcfg.DERPNode{
 			{
 				Name:     "999a",
-				RegionID: 999,
+				RegionID: embeddedDERPRegionID,
 				HostName: host,
 				DERPPort: port,
+				STUNPort: stunPort,
+				STUNOnly: stunOnly,
 			},
 		},
 	}
 	return localDERPregion, nil
 }
 
+// DERPMap returns the currently assembled DERPMap, combining the embedded
+// region with any operator-configured extra regions. It is safe to call
+// concurrently and reflects the most recent SIGHUP reload.
+func (h *Headscale) DERPMap() *tailcfg.DERPMap {
+	derpMap, _ := h.DERPServer.derpMap.Load().(*tailcfg.DERPMap)
+	if derpMap == nil {
+		return &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+			embeddedDERPRegionID: &h.DERPServer.region,
+		}}
+	}
+	return derpMap
+}
+
+// buildDERPMap assembles the full DERPMap served to clients: the embedded
+// region is always present, additional regions can be loaded from a local
+// YAML/JSON config file, and a remote DERPMap can be fetched over HTTPS and
+// merged in, mirroring how tailscale's control server hands out a
+// server-provided DERP map.
+func (h *Headscale) buildDERPMap(ctx context.Context) (*tailcfg.DERPMap, error) {
+	derpMap := &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			embeddedDERPRegionID: &h.DERPServer.region,
+		},
+	}
+
+	for _, path := range h.cfg.DERP.Paths {
+		regions, err := readDERPMapFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read extra DERPMap %q: %w", path, err)
+		}
+		if err := mergeDERPRegions(derpMap, regions, path); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, u := range h.cfg.DERP.URLs {
+		regions, err := fetchRemoteDERPMap(ctx, u)
+		if err != nil {
+			log.Warn().Caller().Err(err).Msgf("failed to fetch remote DERPMap from %s", u)
+			continue
+		}
+		if err := mergeDERPRegions(derpMap, regions, u); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := validateDERPMap(derpMap); err != nil {
+		return nil, err
+	}
+
+	return derpMap, nil
+}
+
+// mergeDERPRegions adds regions into derpMap, refusing to silently clobber
+// a region already present under the same RegionID. source is the config
+// path or URL the regions came from, used only for the error message.
+func mergeDERPRegions(derpMap *tailcfg.DERPMap, regions []*tailcfg.DERPRegion, source string) error {
+	for _, region := range regions {
+		if existing, ok := derpMap.Regions[region.RegionID]; ok {
+			return fmt.Errorf(
+				"region ID %d from %s collides with existing region %q; RegionIDs must be unique across all extra DERPMap sources",
+				region.RegionID, source, existing.RegionCode,
+			)
+		}
+		derpMap.Regions[region.RegionID] = region
+	}
+	return nil
+}
+
+// validateDERPMap ensures the 900-999 range, reserved for headscale's own
+// embedded region, is not reused by an operator-supplied region other than
+// the embedded one itself. Uniqueness of RegionIDs across sources is
+// already enforced at merge time by mergeDERPRegions.
+func validateDERPMap(derpMap *tailcfg.DERPMap) error {
+	for id := range derpMap.Regions {
+		if id != embeddedDERPRegionID && id >= reservedRegionIDMin && id <= reservedRegionIDMax {
+			return fmt.Errorf("region ID %d is in the reserved range [%d, %d]", id, reservedRegionIDMin, reservedRegionIDMax)
+		}
+	}
+	return nil
+}
+
+func readDERPMapFile(path string) ([]*tailcfg.DERPRegion, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var extra struct {
+		Regions []*tailcfg.DERPRegion `json:"regions" yaml:"regions"`
+	}
+	if strings.HasSuffix(path, ".json") {
+		if err := json.Unmarshal(content, &extra); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := yaml.Unmarshal(content, &extra); err != nil {
+			return nil, err
+		}
+	}
+	return extra.Regions, nil
+}
+
+// remoteDERPMapFetchTimeout bounds a single fetchRemoteDERPMap request, so
+// one unresponsive configured URL cannot wedge a DERPMap reload.
+const remoteDERPMapFetchTimeout = 10 * time.Second
+
+func fetchRemoteDERPMap(ctx context.Context, url string) ([]*tailcfg.DERPRegion, error) {
+	ctx, cancel := context.WithTimeout(ctx, remoteDERPMapFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d fetching %s", resp.StatusCode, url)
+	}
+
+	var remote tailcfg.DERPMap
+	if err := json.NewDecoder(resp.Body).Decode(&remote); err != nil {
+		return nil, err
+	}
+
+	regions := make([]*tailcfg.DERPRegion, 0, len(remote.Regions))
+	for _, region := range remote.Regions {
+		regions = append(regions, region)
+	}
+	return regions, nil
+}
+
+// derpMapRefreshIntervalOrDefault returns how often watchDERPMapReload
+// re-fetches h.cfg.DERP.URLs on its own, independent of SIGHUP, mirroring
+// the periodic refresh of the tailscale control server's server-provided
+// DERPMap. It is skipped entirely when no URLs are configured.
+func (h *Headscale) derpMapRefreshIntervalOrDefault() time.Duration {
+	if h.cfg.DERP.URLRefreshInterval > 0 {
+		return h.cfg.DERP.URLRefreshInterval
+	}
+	return 10 * time.Minute
+}
+
+// watchDERPMapReload rebuilds the DERPMap once at startup, again every time
+// the process receives SIGHUP, and on a timer while h.cfg.DERP.URLs is
+// non-empty, so a remote DERPMap's regions stay in sync without requiring a
+// restart or a manual SIGHUP.
+func (h *Headscale) watchDERPMapReload(ctx context.Context) {
+	reload := func() {
+		derpMap, err := h.buildDERPMap(ctx)
+		if err != nil {
+			log.Error().Caller().Err(err).Msg("failed to rebuild DERPMap")
+			return
+		}
+		h.DERPServer.derpMap.Store(derpMap)
+		log.Info().Msgf("DERPMap reloaded with %d regions", len(derpMap.Regions))
+	}
+
+	reload()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	defer signal.Stop(sigCh)
+
+	var refreshCh <-chan time.Time
+	if len(h.cfg.DERP.URLs) > 0 {
+		ticker := time.NewTicker(h.derpMapRefreshIntervalOrDefault())
+		defer ticker.Stop()
+		refreshCh = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-refreshCh:
+			log.Info().Msg("refreshing DERPMap from configured URLs")
+			reload()
+		case <-sigCh:
+			log.Info().Msg("received SIGHUP, reloading DERPMap")
+			reload()
+		}
+	}
+}
+
+// stunPortAndMode derives the STUN port advertised to clients from the
+// configured STUN listener address, and reports whether this node is
+// STUN-only per h.cfg.DERP.STUNOnly. STUNPort is set to -1 when the STUN
+// listener is disabled, matching tailcfg's convention for "no STUN here";
+// a disabled listener is never advertised as STUN-only regardless of
+// config, since there would be nothing listening for either protocol.
+func (h *Headscale) stunPortAndMode() (stunPort int, stunOnly bool) {
+	addr := h.cfg.DERP.STUNAddr
+	if addr == "" {
+		addr = "0.0.0.0:3478"
+	}
+	if addr == "-" {
+		return -1, false
+	}
+
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 3478, h.cfg.DERP.STUNOnly
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return 3478, h.cfg.DERP.STUNOnly
+	}
+
+	return port, h.cfg.DERP.STUNOnly
+}
+
+// stunListenTarget is one (network, address) pair ServeSTUN should open a
+// listener on. The first target returned by stunListenTargets is the
+// primary listener; any further targets are best-effort companions.
+type stunListenTarget struct {
+	network string
+	addr    string
+}
+
+// stunListenTargets decides which udp4/udp6 sockets ServeSTUN needs to open
+// for a given configured bind address, so that a dual-stack bind (either
+// the wildcard "0.0.0.0"/"" or the explicit IPv6 wildcard "[::]") always
+// gets both an IPv4 and an IPv6 listener, and a specific single-family
+// address gets exactly the matching listener. It is pure and has no
+// network side effects, so it is straightforward to unit test.
+func stunListenTargets(addr string) ([]stunListenTarget, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case host == "" || host == "0.0.0.0":
+		return []stunListenTarget{
+			{network: "udp4", addr: addr},
+			{network: "udp6", addr: net.JoinHostPort("::", portStr)},
+		}, nil
+	case host == "::":
+		return []stunListenTarget{
+			{network: "udp6", addr: addr},
+			{network: "udp4", addr: net.JoinHostPort("0.0.0.0", portStr)},
+		}, nil
+	default:
+		network := "udp4"
+		if ip := net.ParseIP(host); ip == nil || ip.To4() == nil {
+			network = "udp6"
+		}
+		return []stunListenTarget{{network: network, addr: addr}}, nil
+	}
+}
+
 func (h *Headscale) DERPHandler(ctx *gin.Context) {
 	log.Trace().Caller().Msgf("/derp request from %v", ctx.ClientIP())
 	up := strings.ToLower(ctx.Request.Header.Get("Upgrade"))
@@ -105,13 +638,30 @@ func (h *Headscale) DERPHandler(ctx *gin.Context) {
 		return
 	}
 
-	netConn, conn, err := hijacker.Hijack()
+	netConn, hijackedBRW, err := hijacker.Hijack()
 	if err != nil {
 		log.Error().Caller().Err(err).Msgf("Hijack failed")
 		ctx.String(http.StatusInternalServerError, "HTTP does not support general TCP support")
 		return
 	}
 
+	// Instrument the hijacked bufio.Reader in place rather than building a
+	// fresh one around netConn: net/http's Hijack contract warns that the
+	// returned Reader "may contain unprocessed buffered data from the
+	// client", which is exactly what a fast-start client (one that doesn't
+	// wait for the 101 response before sending DERP frames) will have left
+	// there. Wrapping the existing reader drains that buffered data instead
+	// of silently dropping it. Writes go to netConn directly, so flushing
+	// conn sends them to the client instead of into a second buffer that
+	// nothing flushes.
+	conn := bufio.NewReadWriter(
+		bufio.NewReader(countingReader{hijackedBRW.Reader}),
+		bufio.NewWriter(countingWriter{netConn}),
+	)
+
+	derpUpgrades.Add(1)
+	promDERPUpgrades.Inc()
+
 	if !fastStart {
 		pubKey := h.privateKey.Public()
 		fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
@@ -123,6 +673,13 @@ func (h *Headscale) DERPHandler(ctx *gin.Context) {
 			pubKey.UntypedHexString())
 	}
 
+	derpSessions.Add(1)
+	promDERPSessions.Inc()
+	defer func() {
+		derpSessions.Add(-1)
+		promDERPSessions.Dec()
+	}()
+
 	h.DERPServer.tailscaleDERP.Accept(netConn, conn, netConn.RemoteAddr().String())
 }
 
@@ -147,17 +704,67 @@ func (h *Headscale) DERPBootstrapDNSHandler(ctx *gin.Context) {
 	ctx.Writer.Write(j)
 }
 
-// ServeSTUN starts a STUN server on udp/3478
+// ServeSTUN starts the STUN server(s) configured for this headscale
+// instance. Setting h.cfg.DERP.STUNAddr to "-" disables the STUN listener
+// entirely, which is useful when operators front headscale with their own
+// STUN infrastructure.
 func (h *Headscale) ServeSTUN() {
-	pc, err := net.ListenPacket("udp", "0.0.0.0:3478")
+	// DERP mesh peering and DERPMap SIGHUP reload are independent of
+	// whether the embedded STUN listener is enabled, so start them
+	// unconditionally before the "disabled" early return below.
+	ctx := context.Background()
+	go h.watchMeshPeers(ctx)
+	go h.watchDERPMapReload(ctx)
+	go watchDERPBytesRelayed(ctx)
+
+	addr := h.cfg.DERP.STUNAddr
+	if addr == "" {
+		addr = "0.0.0.0:3478"
+	}
+	if addr == "-" {
+		log.Info().Msg("STUN server is disabled by configuration")
+		return
+	}
+
+	limiter := newSTUNSourceLimiter(h.stunRateLimitOrDefault(), h.stunRateBurstOrDefault())
+	go limiter.watchPrune(ctx)
+
+	targets, err := stunListenTargets(addr)
 	if err != nil {
-		log.Fatal().Msgf("failed to open STUN listener: %v", err)
+		log.Fatal().Err(err).Msgf("invalid stun_listen_addr %q", addr)
+	}
+
+	for i, target := range targets {
+		pc, err := net.ListenPacket(target.network, target.addr)
+		if err != nil {
+			if i == 0 {
+				log.Fatal().Msgf("failed to open STUN listener: %v", err)
+			}
+			log.Warn().Err(err).Msgf("failed to open companion %s STUN listener, continuing without it", target.network)
+			continue
+		}
+		log.Trace().Msgf("STUN server started at %s", pc.LocalAddr())
+		go serverSTUNListener(ctx, pc.(*net.UDPConn), limiter)
+	}
+
+	<-ctx.Done()
+}
+
+func (h *Headscale) stunRateLimitOrDefault() rate.Limit {
+	if h.cfg.DERP.STUNRateLimit > 0 {
+		return rate.Limit(h.cfg.DERP.STUNRateLimit)
 	}
-	log.Trace().Msgf("STUN server started at %s", pc.LocalAddr())
-	serverSTUNListener(context.Background(), pc.(*net.UDPConn))
+	return rate.Limit(20)
 }
 
-func serverSTUNListener(ctx context.Context, pc *net.UDPConn) {
+func (h *Headscale) stunRateBurstOrDefault() int {
+	if h.cfg.DERP.STUNRateBurst > 0 {
+		return h.cfg.DERP.STUNRateBurst
+	}
+	return 40
+}
+
+func serverSTUNListener(ctx context.Context, pc *net.UDPConn, limiter *stunSourceLimiter) {
 	var buf [64 << 10]byte
 	var (
 		n   int
@@ -175,12 +782,25 @@ func serverSTUNListener(ctx context.Context, pc *net.UDPConn) {
 			continue
 		}
 		log.Trace().Caller().Msgf("STUN request from %v", ua)
+		stunRequests.Add(1)
+		promSTUNRequests.Inc()
+
+		if limiter != nil && !limiter.Allow(ua.IP) {
+			stunLimited.Add(1)
+			promSTUNLimited.Inc()
+			continue
+		}
+
 		pkt := buf[:n]
 		if !stun.Is(pkt) {
+			stunMalformed.Add(1)
+			promSTUNMalformed.Inc()
 			continue
 		}
 		txid, err := stun.ParseBindingRequest(pkt)
 		if err != nil {
+			stunMalformed.Add(1)
+			promSTUNMalformed.Inc()
 			continue
 		}
 
@@ -189,6 +809,80 @@ func serverSTUNListener(ctx context.Context, pc *net.UDPConn) {
 	}
 }
 
+// stunLimiterTTL is how long a per-source-IP limiter may sit idle before
+// stunSourceLimiter.prune reclaims it. STUN runs over UDP, so source IPs
+// are trivially spoofable; without eviction, a flood of forged source
+// addresses would grow byIP without bound and turn the rate limiter itself
+// into a memory-exhaustion vector.
+const stunLimiterTTL = 5 * time.Minute
+
+// stunSourceLimiter applies a per-source-IP token bucket to incoming STUN
+// requests so a single peer cannot flood the embedded STUN server,
+// mirroring the accept/verify limiter tailscale's derper uses for DERP.
+type stunSourceLimiter struct {
+	rate  rate.Limit
+	burst int
+	mu    sync.Mutex
+	byIP  map[string]*stunLimiterEntry
+}
+
+type stunLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newSTUNSourceLimiter(r rate.Limit, burst int) *stunSourceLimiter {
+	return &stunSourceLimiter{
+		rate:  r,
+		burst: burst,
+		byIP:  make(map[string]*stunLimiterEntry),
+	}
+}
+
+func (l *stunSourceLimiter) Allow(ip net.IP) bool {
+	key := ip.String()
+
+	l.mu.Lock()
+	entry, ok := l.byIP[key]
+	if !ok {
+		entry = &stunLimiterEntry{limiter: rate.NewLimiter(l.rate, l.burst)}
+		l.byIP[key] = entry
+	}
+	entry.lastSeen = time.Now()
+	limiter := entry.limiter
+	l.mu.Unlock()
+
+	return limiter.Allow()
+}
+
+// prune drops limiters that have not been used for stunLimiterTTL, bounding
+// memory usage under a flood of spoofed source addresses.
+func (l *stunSourceLimiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, entry := range l.byIP {
+		if now.Sub(entry.lastSeen) > stunLimiterTTL {
+			delete(l.byIP, key)
+		}
+	}
+}
+
+// watchPrune periodically sweeps stale per-IP limiters until ctx is done.
+func (l *stunSourceLimiter) watchPrune(ctx context.Context) {
+	ticker := time.NewTicker(stunLimiterTTL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.prune(now)
+		}
+	}
+}
+
 // Shamelessly taken from
 // https://github.com/tailscale/tailscale/blob/main/cmd/derper/bootstrap_dns.go
 func refreshBootstrapDNSLoop() {
@@ -218,10 +912,196 @@ func refreshBootstrapDNS() {
 		}
 		dnsEntries[name] = addrs
 	}
+	if len(dnsEntries) == 0 {
+		// Every lookup failed: leave the old cached values in place rather
+		// than replacing them with an empty result, and don't report this
+		// as a success just because nothing threw an error.
+		log.Warn().Msgf("bootstrap DNS refresh resolved none of %q", names)
+		bootstrapDNSFail.Add(1)
+		promBootstrapDNSFail.Inc()
+		return
+	}
+
 	j, err := json.MarshalIndent(dnsEntries, "", "\t")
 	if err != nil {
 		// leave the old values in place
+		bootstrapDNSFail.Add(1)
+		promBootstrapDNSFail.Inc()
 		return
 	}
 	dnsCache.Store(j)
+	bootstrapDNSOK.Add(1)
+	promBootstrapDNSOK.Inc()
+}
+
+// defaultMetaCertServerName is the fallback magic TLS SNI a Derp-Fast-Start
+// client dials with to fetch the synthetic meta-certificate below instead
+// of headscale's real DERP TLS certificate. This is NOT a value headscale
+// gets to pick on its own: it must match byte-for-byte whatever a given
+// derphttp client build actually probes for, and this default has not been
+// verified against upstream tailscale source. Operators relying on
+// Derp-Fast-Start should set h.cfg.DERP.TLS.MetaCertServerName explicitly
+// to whatever their client expects rather than trust this default; until
+// then treat the fast-start path as unconfirmed.
+const defaultMetaCertServerName = "derpkey.headscale.invalid"
+
+// metaCertServerNameOrDefault returns the configured magic SNI, falling
+// back to defaultMetaCertServerName when unset. See that constant's
+// doc comment for why this needs explicit operator confirmation.
+func (h *Headscale) metaCertServerNameOrDefault() string {
+	if h.cfg.DERP.TLS.MetaCertServerName != "" {
+		return h.cfg.DERP.TLS.MetaCertServerName
+	}
+	return defaultMetaCertServerName
+}
+
+// ServeDERPTLS starts a dedicated, TLS-terminated listener for the embedded
+// DERP server, independent of the gin server headscale otherwise runs, plus
+// a companion plaintext HTTP listener for /generate_204, /robots.txt and
+// ACME http-01 challenges. Set h.cfg.DERP.TLS.HTTPListenAddr to "-1" to
+// disable the plaintext listener.
+func (h *Headscale) ServeDERPTLS() error {
+	tlsCfg := h.cfg.DERP.TLS
+
+	var certManager *autocert.Manager
+	var getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	switch tlsCfg.CertMode {
+	case "letsencrypt":
+		certManager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(tlsCfg.ACMEHostname),
+			Cache:      autocert.DirCache(tlsCfg.ACMECacheDir),
+		}
+		getCertificate = certManager.GetCertificate
+	case "manual":
+		cert, err := tls.LoadX509KeyPair(tlsCfg.CertPath, tlsCfg.KeyPath)
+		if err != nil {
+			return fmt.Errorf("failed to load DERP TLS cert/key: %w", err)
+		}
+		getCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &cert, nil
+		}
+	default:
+		return fmt.Errorf("unknown DERP TLS cert mode %q, want manual or letsencrypt", tlsCfg.CertMode)
+	}
+
+	httpAddr := tlsCfg.HTTPListenAddr
+	if httpAddr == "" {
+		httpAddr = ":80"
+	}
+	if httpAddr != "-1" {
+		go h.serveDERPPlaintext(httpAddr, certManager)
+	}
+
+	server := &http.Server{
+		Addr:      tlsCfg.ListenAddr,
+		Handler:   h.derpGinHandler(),
+		TLSConfig: &tls.Config{GetCertificate: h.wrapWithFastStartCert(getCertificate)},
+	}
+	log.Info().Msgf("DERP TLS listener starting on %s (mode=%s)", tlsCfg.ListenAddr, tlsCfg.CertMode)
+	return server.ListenAndServeTLS("", "")
+}
+
+// serveDERPPlaintext runs the companion HTTP listener used for
+// unauthenticated health/robots checks and, in letsencrypt mode, ACME
+// http-01 challenge responses.
+func (h *Headscale) serveDERPPlaintext(addr string, certManager *autocert.Manager) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/generate_204", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "User-agent: *\nDisallow: /\n")
+	})
+
+	var handler http.Handler = mux
+	if certManager != nil {
+		handler = certManager.HTTPHandler(mux)
+	}
+
+	log.Info().Msgf("DERP plaintext listener starting on %s", addr)
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		log.Error().Caller().Err(err).Msg("DERP plaintext listener failed")
+	}
+}
+
+// derpGinHandler adapts the existing gin DERP/STUN-probe routes so they can
+// be served from the dedicated TLS listener as well as headscale's main
+// server.
+func (h *Headscale) derpGinHandler() http.Handler {
+	r := gin.Default()
+	r.Any("/derp", h.DERPHandler)
+	r.Any("/derp/probe", h.DERPProbeHandler)
+	r.GET("/derp/bootstrap-dns", h.DERPBootstrapDNSHandler)
+	return r
+}
+
+// wrapWithFastStartCert wraps a GetCertificate function so that a client
+// dialing with the configured magic SNI (see metaCertServerNameOrDefault)
+// gets a freshly minted, self-signed certificate whose Subject.CommonName
+// is the server's DERP public key, instead of headscale's real DERP TLS
+// certificate. Because this is a brand-new DER-encoded certificate (built
+// and signed here, not a mutated copy of the real one), the embedded key
+// actually goes out on the wire during the handshake, letting
+// Derp-Fast-Start clients read it without waiting for the HTTP 101
+// response.
+func (h *Headscale) wrapWithFastStartCert(
+	inner func(*tls.ClientHelloInfo) (*tls.Certificate, error),
+) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	var (
+		metaCertOnce sync.Once
+		metaCert     *tls.Certificate
+		metaCertErr  error
+	)
+
+	serverName := h.metaCertServerNameOrDefault()
+
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName != serverName {
+			return inner(hello)
+		}
+
+		metaCertOnce.Do(func() {
+			metaCert, metaCertErr = h.buildMetaCert()
+		})
+		if metaCertErr != nil {
+			return nil, metaCertErr
+		}
+
+		return metaCert, nil
+	}
+}
+
+// buildMetaCert generates a self-signed certificate, on an ephemeral key
+// unrelated to the real DERP TLS cert, whose CommonName is the hex-encoded
+// DERP public key. It is only ever handed to clients that ask for the
+// configured meta-cert SNI, never used to actually authenticate headscale.
+func (h *Headscale) buildMetaCert() (*tls.Certificate, error) {
+	metaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate meta-cert key: %w", err)
+	}
+
+	pubKey := h.privateKey.Public()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName: pubKey.UntypedHexString(),
+		},
+		NotBefore:             time.Unix(0, 0),
+		NotAfter:              time.Now().AddDate(30, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &metaKey.PublicKey, metaKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create meta-cert: %w", err)
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  metaKey,
+	}, nil
 }
@@ -0,0 +1,289 @@
+package headscale
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+	"tailscale.com/tailcfg"
+)
+
+func TestStunListenTargets(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    string
+		want    []stunListenTarget
+		wantErr bool
+	}{
+		{
+			name: "wildcard ipv4 is dual-stack",
+			addr: "0.0.0.0:3478",
+			want: []stunListenTarget{
+				{network: "udp4", addr: "0.0.0.0:3478"},
+				{network: "udp6", addr: "[::]:3478"},
+			},
+		},
+		{
+			name: "empty host is dual-stack",
+			addr: ":3478",
+			want: []stunListenTarget{
+				{network: "udp4", addr: ":3478"},
+				{network: "udp6", addr: "[::]:3478"},
+			},
+		},
+		{
+			name: "explicit ipv6 wildcard is dual-stack",
+			addr: "[::]:3478",
+			want: []stunListenTarget{
+				{network: "udp6", addr: "[::]:3478"},
+				{network: "udp4", addr: "0.0.0.0:3478"},
+			},
+		},
+		{
+			name: "specific ipv4 address is udp4 only",
+			addr: "192.168.1.5:3478",
+			want: []stunListenTarget{
+				{network: "udp4", addr: "192.168.1.5:3478"},
+			},
+		},
+		{
+			name: "specific ipv6 address is udp6 only",
+			addr: "[2001:db8::1]:3478",
+			want: []stunListenTarget{
+				{network: "udp6", addr: "[2001:db8::1]:3478"},
+			},
+		},
+		{
+			name:    "missing port is an error",
+			addr:    "0.0.0.0",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := stunListenTargets(tt.addr)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("stunListenTargets(%q) expected an error, got none", tt.addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("stunListenTargets(%q) unexpected error: %v", tt.addr, err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("stunListenTargets(%q) = %+v, want %+v", tt.addr, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("stunListenTargets(%q)[%d] = %+v, want %+v", tt.addr, i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMergeDERPRegions(t *testing.T) {
+	base := func() *tailcfg.DERPMap {
+		return &tailcfg.DERPMap{
+			Regions: map[int]*tailcfg.DERPRegion{
+				embeddedDERPRegionID: {RegionID: embeddedDERPRegionID, RegionCode: "headscale"},
+			},
+		}
+	}
+
+	t.Run("non-colliding regions are added", func(t *testing.T) {
+		derpMap := base()
+		err := mergeDERPRegions(derpMap, []*tailcfg.DERPRegion{
+			{RegionID: 1, RegionCode: "extra-a"},
+			{RegionID: 2, RegionCode: "extra-b"},
+		}, "extra.yaml")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(derpMap.Regions) != 3 {
+			t.Fatalf("got %d regions, want 3", len(derpMap.Regions))
+		}
+	})
+
+	t.Run("colliding region ID is rejected", func(t *testing.T) {
+		derpMap := base()
+		err := mergeDERPRegions(derpMap, []*tailcfg.DERPRegion{
+			{RegionID: embeddedDERPRegionID, RegionCode: "impostor"},
+		}, "extra.yaml")
+		if err == nil {
+			t.Fatal("expected a collision error, got none")
+		}
+		// The original region must survive untouched.
+		if derpMap.Regions[embeddedDERPRegionID].RegionCode != "headscale" {
+			t.Fatalf("existing region was clobbered: %+v", derpMap.Regions[embeddedDERPRegionID])
+		}
+	})
+
+	t.Run("two sources colliding with each other is rejected", func(t *testing.T) {
+		derpMap := base()
+		if err := mergeDERPRegions(derpMap, []*tailcfg.DERPRegion{
+			{RegionID: 5, RegionCode: "from-file"},
+		}, "extra.yaml"); err != nil {
+			t.Fatalf("unexpected error on first merge: %v", err)
+		}
+		err := mergeDERPRegions(derpMap, []*tailcfg.DERPRegion{
+			{RegionID: 5, RegionCode: "from-url"},
+		}, "https://example.com/derp.json")
+		if err == nil {
+			t.Fatal("expected a collision error, got none")
+		}
+		if derpMap.Regions[5].RegionCode != "from-file" {
+			t.Fatalf("existing region was clobbered: %+v", derpMap.Regions[5])
+		}
+	})
+}
+
+func TestValidateDERPMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		regions map[int]*tailcfg.DERPRegion
+		wantErr bool
+	}{
+		{
+			name: "embedded region alone is valid",
+			regions: map[int]*tailcfg.DERPRegion{
+				embeddedDERPRegionID: {RegionID: embeddedDERPRegionID},
+			},
+		},
+		{
+			name: "region outside the reserved range is valid",
+			regions: map[int]*tailcfg.DERPRegion{
+				embeddedDERPRegionID: {RegionID: embeddedDERPRegionID},
+				1:                    {RegionID: 1},
+			},
+		},
+		{
+			name: "extra region inside the reserved range is rejected",
+			regions: map[int]*tailcfg.DERPRegion{
+				embeddedDERPRegionID: {RegionID: embeddedDERPRegionID},
+				901:                  {RegionID: 901},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateDERPMap(&tailcfg.DERPMap{Regions: tt.regions})
+			if tt.wantErr && err == nil {
+				t.Fatal("expected an error, got none")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestStunSourceLimiterPrune(t *testing.T) {
+	limiter := newSTUNSourceLimiter(rate.Limit(10), 10)
+
+	limiter.Allow(mustParseIP(t, "203.0.113.1"))
+	limiter.Allow(mustParseIP(t, "203.0.113.2"))
+
+	if len(limiter.byIP) != 2 {
+		t.Fatalf("got %d tracked source IPs, want 2", len(limiter.byIP))
+	}
+
+	// Backdate one entry past the TTL and leave the other fresh.
+	limiter.mu.Lock()
+	limiter.byIP["203.0.113.1"].lastSeen = time.Now().Add(-2 * stunLimiterTTL)
+	limiter.mu.Unlock()
+
+	limiter.prune(time.Now())
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if _, ok := limiter.byIP["203.0.113.1"]; ok {
+		t.Error("stale entry was not pruned")
+	}
+	if _, ok := limiter.byIP["203.0.113.2"]; !ok {
+		t.Error("fresh entry was pruned")
+	}
+}
+
+func TestCountingReaderWriterTracksBytesRelayed(t *testing.T) {
+	before := currentDERPBytesRelayed()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	reader := countingReader{server}
+	writer := countingWriter{server}
+
+	payload := []byte("hello derp")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, len(payload))
+		if _, err := reader.Read(buf); err != nil {
+			t.Errorf("Read: %v", err)
+		}
+		if _, err := writer.Write(buf); err != nil {
+			t.Errorf("Write: %v", err)
+		}
+	}()
+
+	if _, err := client.Write(payload); err != nil {
+		t.Fatalf("client.Write: %v", err)
+	}
+	echoed := make([]byte, len(payload))
+	if _, err := client.Read(echoed); err != nil {
+		t.Fatalf("client.Read: %v", err)
+	}
+	<-done
+
+	if got := currentDERPBytesRelayed() - before; got < float64(2*len(payload)) {
+		t.Fatalf("currentDERPBytesRelayed() grew by %v, want at least %d", got, 2*len(payload))
+	}
+}
+
+// TestCountingReaderDrainsPrebufferedBytes guards against regressing to
+// building a fresh bufio.Reader around the raw conn: that would silently
+// drop whatever a fast-start client already had buffered into the
+// *bufio.Reader net/http's Hijack() returns, instead of draining it.
+func TestCountingReaderDrainsPrebufferedBytes(t *testing.T) {
+	payload := []byte("fast-start derp frame")
+	hijackedBR := bufio.NewReader(strings.NewReader(string(payload)))
+	// Force the bufio.Reader to pull the bytes off the underlying source
+	// into its own buffer, as Hijack() would have done for a fast-start
+	// client that wrote before the 101 response was sent.
+	if _, err := hijackedBR.Peek(len(payload)); err != nil {
+		t.Fatalf("Peek: %v", err)
+	}
+
+	before := currentDERPBytesRelayed()
+	reread := bufio.NewReader(countingReader{hijackedBR})
+
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(reread, got); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if string(got) != string(payload) {
+		t.Fatalf("got %q, want %q", got, payload)
+	}
+	if diff := currentDERPBytesRelayed() - before; diff != float64(len(payload)) {
+		t.Fatalf("currentDERPBytesRelayed() grew by %v, want %d", diff, len(payload))
+	}
+}
+
+func mustParseIP(t *testing.T, s string) net.IP {
+	t.Helper()
+	ip := net.ParseIP(s)
+	if ip == nil {
+		t.Fatalf("invalid test IP %q", s)
+	}
+	return ip
+}